@@ -3,6 +3,7 @@ package agent
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -53,83 +54,114 @@ const (
 	ceMimeType = "application/cloudevents+json"
 )
 
-// FromRequest initialises a call to a route from an HTTP request
-// deprecate with routes
-func FromRequest(app *models.App, route *models.Route, req *http.Request) CallOpt {
-	return func(ctx context.Context, c *call) error {
-		log := common.Logger(ctx)
-		// Check whether this is a CloudEvent, if coming in via HTTP router (only way currently), then we'll look for a special header
-		// Content-Type header: https://github.com/cloudevents/spec/blob/master/http-transport-binding.md#32-structured-content-mode
-		// Expected Content-Type for a CloudEvent: application/cloudevents+json; charset=UTF-8
+// buildRouteCall does everything FromRequest/FromStreamingRequest share:
+// CloudEvent detection, validation, config/trace setup and the call model
+// itself - but stops short of setting the payload, so callers can choose
+// between buffering it (setCallPayload) or streaming it (WithStreamingBody).
+func buildRouteCall(ctx context.Context, app *models.App, route *models.Route, req *http.Request, c *call) error {
+	log := common.Logger(ctx)
+	// Check whether this is a CloudEvent, either structured mode (special
+	// Content-Type header) or binary mode (ce-* headers), per the HTTP
+	// transport binding: https://github.com/cloudevents/spec/blob/master/http-transport-binding.md
+	var err error
+	if isBinaryCloudEvent(req.Header) {
+		c.IsCloudEvent = true
+		c.isBinaryCloudEvent = true
+		route.Format = models.FormatCloudEvent
+	} else {
 		contentType := req.Header.Get("Content-Type")
-		t, _, err := mime.ParseMediaType(contentType)
+		var t string
+		t, _, err = mime.ParseMediaType(contentType)
 		if err != nil {
 			// won't fail here, but log
 			log.Debugf("Could not parse Content-Type header: %v", err)
-		} else {
-			if t == ceMimeType {
-				c.IsCloudEvent = true
-				route.Format = models.FormatCloudEvent
-			}
+		} else if t == ceMimeType {
+			c.IsCloudEvent = true
+			route.Format = models.FormatCloudEvent
 		}
+	}
 
-		if route.Format == "" {
-			route.Format = models.FormatDefault
-		}
+	if route.Format == "" {
+		route.Format = models.FormatDefault
+	}
 
-		id := id.New().String()
+	id := id.New().String()
 
-		// TODO this relies on ordering of opts, but tests make sure it works, probably re-plumb/destroy headers
-		// TODO async should probably supply an http.ResponseWriter that records the logs, to attach response headers to
-		if rw, ok := c.w.(http.ResponseWriter); ok {
-			rw.Header().Add("FN_CALL_ID", id)
-			for k, vs := range route.Headers {
-				for _, v := range vs {
-					// pre-write in these headers to response
-					rw.Header().Add(k, v)
-				}
+	// TODO this relies on ordering of opts, but tests make sure it works, probably re-plumb/destroy headers
+	// TODO async should probably supply an http.ResponseWriter that records the logs, to attach response headers to
+	if rw, ok := c.w.(http.ResponseWriter); ok {
+		rw.Header().Add("FN_CALL_ID", id)
+		for k, vs := range route.Headers {
+			for _, v := range vs {
+				// pre-write in these headers to response
+				rw.Header().Add(k, v)
 			}
 		}
+	}
 
-		// this ensures that there is an image, path, timeouts, memory, etc are valid.
-		// NOTE: this means assign any changes above into route's fields
-		err = route.Validate()
-		if err != nil {
-			return err
-		}
+	// this ensures that there is an image, path, timeouts, memory, etc are valid.
+	// NOTE: this means assign any changes above into route's fields
+	err = route.Validate()
+	if err != nil {
+		return err
+	}
 
-		var syslogURL string
-		if app.SyslogURL != nil {
-			syslogURL = *app.SyslogURL
-		}
+	var syslogURL string
+	if app.SyslogURL != nil {
+		syslogURL = *app.SyslogURL
+	}
 
-		c.Call = &models.Call{
-			ID:    id,
-			Path:  route.Path,
-			Image: route.Image,
-			// Delay: 0,
-			Type:        route.Type,
-			Format:      route.Format,
-			Priority:    new(int32), // TODO this is crucial, apparently
-			Timeout:     route.Timeout,
-			IdleTimeout: route.IdleTimeout,
-			TmpFsSize:   route.TmpFsSize,
-			Memory:      route.Memory,
-			CPUs:        route.CPUs,
-			Config:      buildConfig(app, route),
-			Annotations: app.Annotations.MergeChange(route.Annotations),
-			Headers:     req.Header,
-			CreatedAt:   common.DateTime(time.Now()),
-			URL:         reqURL(req),
-			Method:      req.Method,
-			AppID:       app.ID,
-			SyslogURL:   syslogURL,
-		}
+	c.Call = &models.Call{
+		ID:    id,
+		Path:  route.Path,
+		Image: route.Image,
+		// Delay: 0,
+		Type:        route.Type,
+		Format:      route.Format,
+		Priority:    new(int32), // TODO this is crucial, apparently
+		Timeout:     route.Timeout,
+		IdleTimeout: route.IdleTimeout,
+		TmpFsSize:   route.TmpFsSize,
+		Memory:      route.Memory,
+		CPUs:        route.CPUs,
+		Config:      buildConfig(ctx, app, route, req.Header),
+		Annotations: app.Annotations.MergeChange(route.Annotations),
+		Headers:     req.Header,
+		CreatedAt:   common.DateTime(time.Now()),
+		URL:         reqURL(req),
+		Method:      req.Method,
+		AppID:       app.ID,
+		SyslogURL:   syslogURL,
+	}
 
+	return nil
+}
+
+// FromRequest initialises a call to a route from an HTTP request
+// deprecate with routes
+func FromRequest(app *models.App, route *models.Route, req *http.Request) CallOpt {
+	return func(ctx context.Context, c *call) error {
+		if err := buildRouteCall(ctx, app, route, req, c); err != nil {
+			return err
+		}
 		return setCallPayload(ctx, req.Body, c)
 	}
 }
 
+// FromStreamingRequest initialises a call the same way FromRequest does,
+// but opts the call into streaming mode: req.Body is plumbed straight
+// through to the container via Call's StreamingPayload instead of being
+// buffered up front, so large or long-lived bodies don't have to fit in
+// memory before the container can start consuming them.
+func FromStreamingRequest(app *models.App, route *models.Route, req *http.Request) CallOpt {
+	return func(ctx context.Context, c *call) error {
+		if err := buildRouteCall(ctx, app, route, req, c); err != nil {
+			return err
+		}
+		return WithStreamingBody(req.Body, defaultMaxInFlight)(ctx, c)
+	}
+}
+
 // SPEC:
 
 //cloudevent {
@@ -160,71 +192,100 @@ func FromRequest(app *models.App, route *models.Route, req *http.Request) CallOp
 //},
 //}
 
+// buildCloudEvent parses req into a single canonical cloudevent.CloudEvent,
+// handling both binary mode (ce-* headers, body as Data - see
+// fromBinaryCloudEvent) and structured
+// mode (application/cloudevents+json body). Either way the original
+// request's headers/url/method are carried along under the "protocol"
+// extension so that FromEvent and the response path can recover them.
 func buildCloudEvent(req *http.Request) (*cloudevent.CloudEvent, error) {
 	var ce cloudevent.CloudEvent
-	// XXX(reed): ???
-	ext := make(map[string]interface{}, 3)
+	ext := make(map[string]interface{}, 4)
 	ext["app"] = new(models.App)
 	ext["trigger"] = new(models.Trigger)
 	ext["fn"] = new(models.Fn)
 	ce.Extensions = ext
-	err := ce.FromRequest(req)
-	return &ce, err
+
+	var err error
+	if isBinaryCloudEvent(req.Header) {
+		err = fromBinaryCloudEvent(req, &ce)
+	} else {
+		err = ce.FromRequest(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ext["protocol"] = newProtocolExtension(req)
+	return &ce, nil
 }
 
-// XXX(reed): for the split mode we need to support invoke that takes a fully built event, with
-// the function/app/trigger unwound inside the event. we also need a way to build this state up,
-// it's possible the two should interlope but maybe not. start without building squat here.
-//
-// thinking: we add the concrete event onto the call object to tote around and re-encode to the container,
-// and a call is simply the extraction of information we need from the event object for the agent to use.
-// we also need to plumb out the container responses all the way up preferably so that Submit returns an event?
-//
-// trigger only things?
-// XXX(reed): shove headers into `protocol: { headers: { } }`
-// XXX(reed): shove url into `protocol: `{ url: "" }` ? also eventURL
-// XXX(reed): shove method into `protocol: `{ method: "" }` ? also eventURL
+// FromEvent builds a call from a fully formed cloud event, where the
+// app/fn/trigger have already been unwound into the event's extensions (see
+// buildCloudEvent). The concrete event is not kept on the call today -
+// everything the agent needs to run the call is copied out here - but the
+// original protocol extension (headers/url/method) is restored onto the
+// call so responses can still be re-encoded to match the inbound transport.
 func FromEvent(event *cloudevent.CloudEvent) CallOpt {
 	return func(ctx context.Context, c *call) error {
-		ext, ok := event.Extensions.(map[string]interface{}) // XXX(reed): ?
+		ext, ok := event.Extensions.(map[string]interface{})
 		if !ok {
 			return errors.New("cloud event extensions must be marshaled with known type")
 		}
 
-		// XXX(reed): prob need a map. ignore for a minute
-		app := ext["app"].(*models.App)
-		fn := ext["fn"].(*models.Fn)
-		trigger := ext["fn"].(*models.Trigger)
+		app, ok := ext["app"].(*models.App)
+		if !ok {
+			return errors.New("cloud event missing app extension")
+		}
+		fn, ok := ext["fn"].(*models.Fn)
+		if !ok {
+			return errors.New("cloud event missing fn extension")
+		}
+		trigger, ok := ext["trigger"].(*models.Trigger)
+		if !ok {
+			return errors.New("cloud event missing trigger extension")
+		}
 
 		var syslogURL string
 		if app.SyslogURL != nil {
 			syslogURL = *app.SyslogURL
 		}
 
+		var headers http.Header
+		proto, ok := ext["protocol"].(*protocolExtension)
+		if ok {
+			headers = proto.Headers
+		}
+
 		c.Call = &models.Call{
-			// XXX(reed): these are the fields agent needs to run the thing, everything else
-			// we can leave in cloud event format.
-			// DO NOT MODIFY FIELDS DINGUS
 			ID:          id.New().String(),
+			Path:        trigger.Source,
 			Image:       fn.Image,
+			Type:        "sync",
+			Format:      models.FormatCloudEvent,
+			Priority:    new(int32),
 			Timeout:     fn.Timeout,
 			IdleTimeout: fn.IdleTimeout,
-			TmpFsSize:   0, // TODO clean up this
+			TmpFsSize:   fn.TmpFsSize,
 			Memory:      fn.Memory,
-			CPUs:        0, // TODO clean up this
-			SyslogURL:   syslogURL,
-			// TODO - this wasn't really the intention here (that annotations would naturally cascade
-			// but seems to be necessary for some runner behaviour
-			// XXX(reed): we need annotations right?
+			CPUs:        fn.CPUs,
+			Config:      buildTriggerConfig(ctx, app, fn, trigger, headers),
 			Annotations: app.Annotations.MergeChange(fn.Annotations).MergeChange(trigger.Annotations),
-			// XXX(reed): some checksum / version for hotties (ugh)
-			// XXX(reed): http handler should add eventURL ?
+			AppID:       app.ID,
+			FnID:        fn.ID,
+			TriggerID:   trigger.ID,
+			SyslogURL:   syslogURL,
+		}
 
-			// TODO DEPRECATE / NUKE
-			Type:   "sync",
-			Format: "cloudevent",
+		if ok {
+			c.Call.Headers = proto.Headers
+			c.Call.URL = proto.URL
+			c.Call.Method = proto.Method
+			c.isBinaryCloudEvent = isBinaryCloudEvent(proto.Headers)
 		}
 
+		c.IsCloudEvent = true
+
 		return nil
 	}
 }
@@ -234,16 +295,20 @@ func FromEvent(event *cloudevent.CloudEvent) CallOpt {
 func FromHTTPTriggerRequest(app *models.App, fn *models.Fn, trigger *models.Trigger, req *http.Request) CallOpt {
 	return func(ctx context.Context, c *call) error {
 		log := common.Logger(ctx)
-		// Check whether this is a CloudEvent, if coming in via HTTP router (only way currently), then we'll look for a special header
-		// Content-Type header: https://github.com/cloudevents/spec/blob/master/http-transport-binding.md#32-structured-content-mode
-		// Expected Content-Type for a CloudEvent: application/cloudevents+json; charset=UTF-8
-		contentType := req.Header.Get("Content-Type")
-		t, _, err := mime.ParseMediaType(contentType)
-		if err != nil {
-			// won't fail here, but log
-			log.Debugf("Could not parse Content-Type header: %v", err)
+		// Check whether this is a CloudEvent, either structured mode (special
+		// Content-Type header) or binary mode (ce-* headers), per the HTTP
+		// transport binding: https://github.com/cloudevents/spec/blob/master/http-transport-binding.md
+		if isBinaryCloudEvent(req.Header) {
+			c.IsCloudEvent = true
+			c.isBinaryCloudEvent = true
+			fn.Format = models.FormatCloudEvent
 		} else {
-			if t == ceMimeType {
+			contentType := req.Header.Get("Content-Type")
+			t, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				// won't fail here, but log
+				log.Debugf("Could not parse Content-Type header: %v", err)
+			} else if t == ceMimeType {
 				c.IsCloudEvent = true
 				fn.Format = models.FormatCloudEvent
 			}
@@ -279,7 +344,7 @@ func FromHTTPTriggerRequest(app *models.App, fn *models.Fn, trigger *models.Trig
 			TmpFsSize:   0, // TODO clean up this
 			Memory:      fn.Memory,
 			CPUs:        0, // TODO clean up this
-			Config:      buildTriggerConfig(app, fn, trigger),
+			Config:      buildTriggerConfig(ctx, app, fn, trigger, req.Header),
 			// TODO - this wasn't really the intention here (that annotations would naturally cascade
 			// but seems to be necessary for some runner behaviour
 			Annotations: app.Annotations.MergeChange(fn.Annotations).MergeChange(trigger.Annotations),
@@ -297,7 +362,11 @@ func FromHTTPTriggerRequest(app *models.App, fn *models.Fn, trigger *models.Trig
 	}
 }
 
-func buildConfig(app *models.App, route *models.Route) models.Config {
+// buildConfig assembles the container env for a route call, including the
+// FN_TRACE_ID/FN_SPAN_ID/FN_TRACE_FLAGS carried over from header's
+// distributed-trace correlation headers (see injectTraceContext), and
+// re-emits a fresh traceparent onto header for downstream propagation.
+func buildConfig(ctx context.Context, app *models.App, route *models.Route, header http.Header) models.Config {
 	conf := make(models.Config, 8+len(app.Config)+len(route.Config))
 	for k, v := range app.Config {
 		conf[k] = v
@@ -318,10 +387,18 @@ func buildConfig(app *models.App, route *models.Route) models.Config {
 	if CPUs != "" {
 		conf["FN_CPUS"] = CPUs
 	}
+
+	if sc := injectTraceContext(ctx, header, conf); sc.TraceID != (trace.TraceID{}) {
+		header.Set("traceparent", traceParentHeader(sc))
+	}
+
 	return conf
 }
 
-func buildTriggerConfig(app *models.App, fn *models.Fn, trigger *models.Trigger) models.Config {
+// buildTriggerConfig assembles the container env for a trigger call. header
+// may be nil (e.g. when building from a cloud event with no protocol
+// extension), in which case trace propagation is skipped.
+func buildTriggerConfig(ctx context.Context, app *models.App, fn *models.Fn, trigger *models.Trigger, header http.Header) models.Config {
 	conf := make(models.Config, 8+len(app.Config)+len(fn.Config))
 	for k, v := range app.Config {
 		conf[k] = v
@@ -338,6 +415,12 @@ func buildTriggerConfig(app *models.App, fn *models.Fn, trigger *models.Trigger)
 	conf["FN_TYPE"] = "sync"
 	conf["FN_FN_ID"] = fn.ID
 
+	if header != nil {
+		if sc := injectTraceContext(ctx, header, conf); sc.TraceID != (trace.TraceID{}) {
+			header.Set("traceparent", traceParentHeader(sc))
+		}
+	}
+
 	return conf
 }
 
@@ -359,6 +442,7 @@ func reqURL(req *http.Request) string {
 func FromModel(mCall *models.Call) CallOpt {
 	return func(ctx context.Context, c *call) error {
 		c.Call = mCall
+		applyStoredTraceContext(c.Call)
 		return nil
 	}
 }
@@ -367,6 +451,7 @@ func FromModel(mCall *models.Call) CallOpt {
 func FromModelAndInput(mCall *models.Call, in io.ReadCloser) CallOpt {
 	return func(ctx context.Context, c *call) error {
 		c.Call = mCall
+		applyStoredTraceContext(c.Call)
 		return setCallPayload(ctx, in, c)
 	}
 }
@@ -434,6 +519,18 @@ func (a *agent) GetCall(ctx context.Context, opts ...CallOpt) (Call, error) {
 		c.w = c.stderr
 	}
 
+	// Cloud event calls get their container's raw response captured rather
+	// than streamed straight through, so End can re-encode it as a cloud
+	// event (in the same transport mode the request arrived in) before it
+	// reaches the real ResponseWriter.
+	if c.IsCloudEvent {
+		if rw, ok := c.w.(http.ResponseWriter); ok {
+			c.ceResponseWriter = rw
+			c.ceCapture = &bytes.Buffer{}
+			c.w = c.ceCapture
+		}
+	}
+
 	return &c, nil
 }
 
@@ -471,6 +568,10 @@ type call struct {
 	// IsCloudEvent flag whether this was ingested as a cloud event. This may become the default or only way.
 	IsCloudEvent bool `json:"is_cloud_event"`
 
+	// isBinaryCloudEvent records which HTTP transport mode the inbound cloud
+	// event used, so the response can be re-encoded the same way.
+	isBinaryCloudEvent bool
+
 	handler        CallHandler
 	w              io.Writer
 	stderr         io.ReadWriteCloser
@@ -483,6 +584,28 @@ type call struct {
 
 	// LB & Pure Runner Extra Config
 	extensions map[string]string
+
+	// streamingBody/maxInFlight back StreamingPayload for calls opted into
+	// streaming via WithStreamingBody/FromStreamingRequest. Left nil for
+	// calls using the buffered Payload path. streamingReader caches the
+	// backpressured reader StreamingPayload builds over streamingBody, so
+	// repeat calls to RequestBody don't spawn a second producer goroutine
+	// over the same body.
+	streamingBody   io.ReadCloser
+	maxInFlight     int
+	streamingReader io.ReadCloser
+
+	// framedIO is set by WithFramedIO to opt a streaming call into the
+	// length-prefixed frame protocol on both input and output.
+	framedIO bool
+
+	// ceCapture/ceResponseWriter back the cloud event response re-encoding
+	// in End: when IsCloudEvent, GetCall redirects c.w into ceCapture so the
+	// container's raw response can be wrapped back into a cloud event (in
+	// the same binary/structured mode the request came in as) before it's
+	// written to the real ceResponseWriter.
+	ceCapture        *bytes.Buffer
+	ceResponseWriter http.ResponseWriter
 }
 
 // SlotHashId returns a string identity for this call that can be used to uniquely place the call in a given container
@@ -495,11 +618,21 @@ func (c *call) Extensions() map[string]string {
 	return c.extensions
 }
 
+// RequestBody returns the call's input. For calls opted into streaming via
+// WithStreamingBody/FromStreamingRequest this is the live, backpressured
+// request body; otherwise it falls back transparently to the buffered
+// Payload, so routes that haven't opted in keep working unchanged.
 func (c *call) RequestBody() io.ReadCloser {
+	if c.streamingBody != nil {
+		return c.StreamingPayload()
+	}
 	return ioutil.NopCloser(strings.NewReader(c.Payload))
 }
 
 func (c *call) ResponseWriter() http.ResponseWriter {
+	if c.ceResponseWriter != nil {
+		return c.ceResponseWriter
+	}
 	return c.w.(http.ResponseWriter)
 }
 
@@ -509,6 +642,55 @@ func (c *call) StdErr() io.ReadWriteCloser {
 
 func (c *call) Model() *models.Call { return c.Call }
 
+// IsBinaryCloudEvent reports whether this call was ingested as a binary
+// mode cloud event (as opposed to structured mode), so the response can be
+// re-encoded using the same transport mode.
+func (c *call) IsBinaryCloudEvent() bool { return c.isBinaryCloudEvent }
+
+// writeCloudEventResponse wraps the container's captured raw response as a
+// cloud event and writes it to the real ResponseWriter, in whichever
+// transport mode (binary/structured) the inbound request used. If the
+// function's own response already parses as a cloud event (i.e. it set its
+// own ce-id/ce-type/etc itself), those fields are kept as-is and
+// encodeCloudEventResponse only fills in ce-id/ce-time if still missing;
+// otherwise the raw response becomes the event Data (decoded as JSON when
+// possible, carried as a raw string otherwise). callErr, if non-nil, means
+// the call itself failed rather than producing a response - the container
+// may not have written anything to re-encode, so a minimal error cloud
+// event is built instead.
+func (c *call) writeCloudEventResponse(callErr error) error {
+	raw := c.ceCapture.Bytes()
+
+	var ce cloudevent.CloudEvent
+	if callErr == nil {
+		var fromFn cloudevent.CloudEvent
+		if err := json.Unmarshal(raw, &fromFn); err == nil && fromFn.EventType != "" {
+			ce = fromFn
+		}
+	}
+
+	if ce.EventType == "" {
+		ce.CloudEventsVersion = "1.0"
+		ce.Source = c.Call.Path
+		ce.ContentType = "application/json"
+
+		if callErr != nil {
+			ce.EventType = "io.fn.error"
+			ce.Data = map[string]interface{}{"error": callErr.Error()}
+		} else {
+			ce.EventType = "io.fn.response"
+			var data interface{}
+			if err := json.Unmarshal(raw, &data); err == nil {
+				ce.Data = data
+			} else {
+				ce.Data = string(raw)
+			}
+		}
+	}
+
+	return encodeCloudEventResponse(c.ceResponseWriter, c.isBinaryCloudEvent, &ce)
+}
+
 func (c *call) Start(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "agent_call_start")
 	defer span.End()
@@ -568,6 +750,12 @@ func (c *call) End(ctx context.Context, errIn error) error {
 		c.Error = errIn.Error()
 	}
 
+	if c.ceCapture != nil {
+		if err := c.writeCloudEventResponse(errIn); err != nil {
+			common.Logger(ctx).WithError(err).Error("error re-encoding cloud event response")
+		}
+	}
+
 	// ensure stats histogram is reasonably bounded
 	c.Call.Stats = drivers.Decimate(240, c.Call.Stats)
 
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fnproject/cloudevent"
+	"github.com/fnproject/fn/api/id"
+)
+
+// CloudEvents 1.0 HTTP transport binding binary mode headers:
+// https://github.com/cloudevents/spec/blob/master/http-transport-binding.md#31-binary-content-mode
+const (
+	ceHeaderSpecVersion = "ce-specversion"
+	ceHeaderID          = "ce-id"
+	ceHeaderType        = "ce-type"
+	ceHeaderSource      = "ce-source"
+	ceHeaderTime        = "ce-time"
+	ceHeaderSchemaURL   = "ce-schemaurl"
+)
+
+// protocolExtension carries the bits of the original HTTP request (or
+// response) that aren't part of the cloud event itself, but that the
+// container - and the response path - still need: headers, the request
+// URL and the HTTP method. It travels as the "protocol" extension on the
+// cloud event, per the SPEC comment above buildCloudEvent.
+type protocolExtension struct {
+	Headers http.Header `json:"headers"`
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+}
+
+func newProtocolExtension(req *http.Request) *protocolExtension {
+	return &protocolExtension{
+		Headers: req.Header,
+		URL:     reqURL(req),
+		Method:  req.Method,
+	}
+}
+
+// isBinaryCloudEvent reports whether header carries the minimum set of
+// binary mode cloud event headers. Per spec, ce-specversion/ce-id/ce-type/
+// ce-source are mandatory in binary mode, so their presence is sufficient
+// to distinguish it from a plain (or structured mode) request.
+func isBinaryCloudEvent(header http.Header) bool {
+	return header.Get(ceHeaderSpecVersion) != "" &&
+		header.Get(ceHeaderID) != "" &&
+		header.Get(ceHeaderType) != "" &&
+		header.Get(ceHeaderSource) != ""
+}
+
+// fromBinaryCloudEvent populates ce from req's ce-* headers, with the
+// request body as the event Data: decoded into a JSON object when the
+// Content-Type is empty or application/json and the body is one, the raw
+// body reader otherwise. ce.Extensions must already be set by the caller
+// (buildCloudEvent seeds it with app/trigger/fn).
+func fromBinaryCloudEvent(req *http.Request, ce *cloudevent.CloudEvent) error {
+	ce.CloudEventsVersion = req.Header.Get(ceHeaderSpecVersion)
+	ce.EventID = req.Header.Get(ceHeaderID)
+	ce.EventType = req.Header.Get(ceHeaderType)
+	ce.Source = req.Header.Get(ceHeaderSource)
+	ce.SchemaURL = req.Header.Get(ceHeaderSchemaURL)
+	ce.ContentType = req.Header.Get("Content-Type")
+
+	if t := req.Header.Get(ceHeaderTime); t != "" {
+		eventTime, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return err
+		}
+		ce.EventTime = &eventTime
+	}
+
+	body := make(map[string]interface{})
+	// binary mode data need not be JSON at all (ce.ContentType says what it
+	// is) - only attempt to decode it when the content type says it's JSON,
+	// otherwise hand the raw reader through untouched.
+	if ce.ContentType == "" || ce.ContentType == "application/json" {
+		var consumed bytes.Buffer
+		dec := json.NewDecoder(io.TeeReader(req.Body, &consumed))
+		if err := dec.Decode(&body); err == nil {
+			ce.Data = body
+			return nil
+		}
+		// not a JSON object: put back what the decoder already read
+		ce.Data = io.MultiReader(&consumed, req.Body)
+		return nil
+	}
+	ce.Data = req.Body
+	return nil
+}
+
+// encodeCloudEventResponse writes the container's response back out in the
+// same cloud event transport mode the inbound request used, filling in
+// ce-id/ce-time when the function's response didn't set them.
+func encodeCloudEventResponse(w http.ResponseWriter, binary bool, ce *cloudevent.CloudEvent) error {
+	if ce.EventID == "" {
+		ce.EventID = id.New().String()
+	}
+	if ce.EventTime == nil {
+		now := time.Now()
+		ce.EventTime = &now
+	}
+
+	if !binary {
+		w.Header().Set("Content-Type", ceMimeType)
+		return json.NewEncoder(w).Encode(ce)
+	}
+
+	w.Header().Set(ceHeaderSpecVersion, ce.CloudEventsVersion)
+	w.Header().Set(ceHeaderID, ce.EventID)
+	w.Header().Set(ceHeaderType, ce.EventType)
+	w.Header().Set(ceHeaderSource, ce.Source)
+	w.Header().Set(ceHeaderTime, ce.EventTime.Format(time.RFC3339Nano))
+	if ce.SchemaURL != "" {
+		w.Header().Set(ceHeaderSchemaURL, ce.SchemaURL)
+	}
+	if ce.ContentType != "" {
+		w.Header().Set("Content-Type", ce.ContentType)
+	}
+	return json.NewEncoder(w).Encode(ce.Data)
+}
@@ -0,0 +1,443 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fnproject/fn/api/common"
+	"github.com/fnproject/fn/api/id"
+	"github.com/fnproject/fn/api/models"
+)
+
+// FanoutStrategyAnnotation selects how a fanout trigger's child responses
+// are aggregated into the one response written back to the caller. See
+// NewAggregator for the supported values.
+const FanoutStrategyAnnotation = "fn.io/fanout-strategy"
+
+// Aggregator combines the responses of a fan-out's child calls into a
+// single response.
+type Aggregator interface {
+	// Aggregate records one child's result, keyed by fn ID, and reports
+	// whether the aggregator now has everything it needs to produce a final
+	// response. Once Aggregate returns true, any still-running children's
+	// results are ignored.
+	Aggregate(fnID string, status int, header http.Header, body []byte, err error) (ready bool)
+
+	// Done writes the aggregated response to w. Called once Aggregate
+	// reports ready, or the fanout's context is done.
+	Done(w http.ResponseWriter) error
+}
+
+// NewAggregator builds the Aggregator named by strategy for a fanout of n
+// children. Supported strategies: "first" (default - first response wins),
+// "all" (every child must succeed), "quorum:N" (at least N children must
+// succeed) and "merge-json" (each child's JSON object body is shallow
+// merged into one).
+func NewAggregator(strategy string, n int) (Aggregator, error) {
+	switch {
+	case strategy == "" || strategy == "first":
+		return &firstAggregator{}, nil
+	case strategy == "all":
+		return &allAggregator{collectingAggregator{expect: n, quorum: n}}, nil
+	case strategy == "merge-json":
+		return &mergeJSONAggregator{collectingAggregator{expect: n, quorum: n + 1}}, nil
+	case strings.HasPrefix(strategy, "quorum:"):
+		q, err := strconv.Atoi(strings.TrimPrefix(strategy, "quorum:"))
+		if err != nil || q <= 0 || q > n {
+			return nil, fmt.Errorf("invalid %s annotation %q", FanoutStrategyAnnotation, strategy)
+		}
+		return &quorumAggregator{collectingAggregator{expect: n, quorum: q}}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s annotation %q", FanoutStrategyAnnotation, strategy)
+	}
+}
+
+// fanoutChildResult is one child fn's outcome: either a response (status,
+// header, body) or err if the call itself never produced one.
+type fanoutChildResult struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Err    error
+}
+
+func (r *fanoutChildResult) failed() bool {
+	return r.Err != nil || r.Status >= 400
+}
+
+func (r *fanoutChildResult) failure() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("status %d", r.Status)
+}
+
+// firstAggregator is satisfied by whichever child responds first; later
+// results are ignored.
+type firstAggregator struct {
+	mu     sync.Mutex
+	result *fanoutChildResult
+}
+
+func (a *firstAggregator) Aggregate(fnID string, status int, header http.Header, body []byte, err error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.result == nil {
+		a.result = &fanoutChildResult{Status: status, Header: header, Body: body, Err: err}
+	}
+	return true
+}
+
+func (a *firstAggregator) Done(w http.ResponseWriter) error {
+	a.mu.Lock()
+	r := a.result
+	a.mu.Unlock()
+
+	if r == nil {
+		return writeFanoutError(w, map[string]string{"": "no child responded"})
+	}
+	if r.failed() {
+		return writeFanoutError(w, map[string]string{"": r.failure()})
+	}
+	return writeChildResponse(w, r)
+}
+
+// collectingAggregator accumulates every child's result, keyed by fn ID,
+// and reports ready once either `quorum` children have succeeded or all
+// `expect` children have reported in (whichever comes first).
+type collectingAggregator struct {
+	mu       sync.Mutex
+	expect   int
+	quorum   int
+	results  map[string]*fanoutChildResult
+	successN int
+}
+
+func (a *collectingAggregator) aggregate(fnID string, status int, header http.Header, body []byte, err error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.results == nil {
+		a.results = make(map[string]*fanoutChildResult, a.expect)
+	}
+	r := &fanoutChildResult{Status: status, Header: header, Body: body, Err: err}
+	a.results[fnID] = r
+	if !r.failed() {
+		a.successN++
+	}
+
+	return a.successN >= a.quorum || len(a.results) >= a.expect
+}
+
+// snapshot returns a copy of the results collected so far. A copy - not the
+// live map - is required: quorumAggregator's Done runs as soon as quorum is
+// met, while straggler children may still be calling aggregate() (which
+// writes a.results) from their own goroutines, so handing out the live map
+// would let writeMergedResponses range it unlocked while it's concurrently
+// written, panicking with "concurrent map iteration and map write".
+func (a *collectingAggregator) snapshot() (map[string]*fanoutChildResult, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	results := make(map[string]*fanoutChildResult, len(a.results))
+	for k, v := range a.results {
+		results[k] = v
+	}
+	return results, a.successN
+}
+
+// allAggregator requires every child to succeed.
+type allAggregator struct{ collectingAggregator }
+
+func (a *allAggregator) Aggregate(fnID string, status int, header http.Header, body []byte, err error) bool {
+	return a.aggregate(fnID, status, header, body, err)
+}
+
+func (a *allAggregator) Done(w http.ResponseWriter) error {
+	results, successN := a.snapshot()
+	if successN < a.expect {
+		return writeFanoutError(w, failures(results))
+	}
+	return writeMergedResponses(w, results)
+}
+
+// quorumAggregator requires at least `quorum` children to succeed, and
+// doesn't wait on stragglers once that many have reported success.
+type quorumAggregator struct{ collectingAggregator }
+
+func (a *quorumAggregator) Aggregate(fnID string, status int, header http.Header, body []byte, err error) bool {
+	return a.aggregate(fnID, status, header, body, err)
+}
+
+func (a *quorumAggregator) Done(w http.ResponseWriter) error {
+	results, successN := a.snapshot()
+	if successN < a.quorum {
+		return writeFanoutError(w, failures(results))
+	}
+	return writeMergedResponses(w, results)
+}
+
+// mergeJSONAggregator shallow-merges every successful child's JSON object
+// body into a single JSON object, keyed by the object's own top-level
+// keys (later children win on key collision). Always waits for every
+// child, since a merge can't be judged complete early.
+type mergeJSONAggregator struct{ collectingAggregator }
+
+func (a *mergeJSONAggregator) Aggregate(fnID string, status int, header http.Header, body []byte, err error) bool {
+	return a.aggregate(fnID, status, header, body, err)
+}
+
+func (a *mergeJSONAggregator) Done(w http.ResponseWriter) error {
+	results, _ := a.snapshot()
+
+	merged := make(map[string]interface{})
+	errs := make(map[string]string)
+	for fnID, r := range results {
+		if r.failed() {
+			errs[fnID] = r.failure()
+			continue
+		}
+		var partial map[string]interface{}
+		if err := json.Unmarshal(r.Body, &partial); err != nil {
+			errs[fnID] = fmt.Sprintf("non-JSON-object response: %v", err)
+			continue
+		}
+		for k, v := range partial {
+			merged[k] = v
+		}
+	}
+
+	if len(merged) == 0 && len(errs) > 0 {
+		return writeFanoutError(w, errs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(merged)
+}
+
+func failures(results map[string]*fanoutChildResult) map[string]string {
+	errs := make(map[string]string)
+	for fnID, r := range results {
+		if r.failed() {
+			errs[fnID] = r.failure()
+		}
+	}
+	return errs
+}
+
+// writeMergedResponses writes every successful child's status/body, keyed
+// by fn ID, as a single JSON object response.
+func writeMergedResponses(w http.ResponseWriter, results map[string]*fanoutChildResult) error {
+	type childResponse struct {
+		Status int             `json:"status"`
+		Body   json.RawMessage `json:"body"`
+	}
+
+	merged := make(map[string]childResponse, len(results))
+	for fnID, r := range results {
+		if !r.failed() {
+			merged[fnID] = childResponse{Status: r.Status, Body: r.Body}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(merged)
+}
+
+// writeFanoutError writes a structured JSON error body, keyed by fn ID,
+// for a fanout that didn't meet its aggregator's success requirement.
+func writeFanoutError(w http.ResponseWriter, failures map[string]string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	return json.NewEncoder(w).Encode(struct {
+		Error    string            `json:"error"`
+		Failures map[string]string `json:"failures"`
+	}{
+		Error:    "fanout: aggregator's success requirement was not met",
+		Failures: failures,
+	})
+}
+
+// writeChildResponse copies a single child's status/header/body through to
+// w verbatim.
+func writeChildResponse(w http.ResponseWriter, r *fanoutChildResult) error {
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(r.Body)
+	return err
+}
+
+// fanoutCall is the Call returned by FromFanoutRequest: its Start fans the
+// inbound request out to every child fn in parallel, and its End writes
+// the aggregated result to the original caller's ResponseWriter.
+type fanoutCall struct {
+	agent      *agent
+	app        *models.App
+	trigger    *models.Trigger
+	req        *http.Request
+	rw         http.ResponseWriter
+	aggregator Aggregator
+	children   []*models.Fn
+
+	model *models.Call
+}
+
+// FromFanoutRequest builds a Call that fans a single incoming request out
+// to every fn in fns in parallel and merges their responses according to
+// the trigger's fn.io/fanout-strategy annotation (default: first response
+// wins). The underlying work is N concurrent child calls, each run through
+// a.GetCall+a.Submit, rather than one container invoke - so drive the
+// returned Call via its own Submit method, not agent.Submit: its concrete
+// type isn't *call, and agent.Submit isn't guaranteed to accept anything
+// else.
+func (a *agent) FromFanoutRequest(app *models.App, fns []*models.Fn, trigger *models.Trigger, req *http.Request, rw http.ResponseWriter) (Call, error) {
+	if len(fns) == 0 {
+		return nil, errors.New("fanout requires at least one fn")
+	}
+
+	var strategy string
+	if raw, ok := trigger.Annotations[FanoutStrategyAnnotation]; ok {
+		if err := json.Unmarshal(raw, &strategy); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", FanoutStrategyAnnotation, err)
+		}
+	}
+
+	aggregator, err := NewAggregator(strategy, len(fns))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fanoutCall{
+		agent:      a,
+		app:        app,
+		trigger:    trigger,
+		req:        req,
+		rw:         rw,
+		aggregator: aggregator,
+		children:   fns,
+		model: &models.Call{
+			ID:        id.New().String(),
+			Path:      trigger.Source,
+			Type:      "sync",
+			Format:    models.FormatDefault,
+			Priority:  new(int32),
+			CreatedAt: common.DateTime(time.Now()),
+			URL:       reqURL(req),
+			Method:    req.Method,
+			AppID:     app.ID,
+			TriggerID: trigger.ID,
+		},
+	}, nil
+}
+
+func (c *fanoutCall) Model() *models.Call { return c.model }
+
+// Submit drives the fanout to completion: Start, then End with whatever
+// error Start returned. Callers should use this rather than agent.Submit,
+// since a fanoutCall isn't the *call concrete type agent.Submit is written
+// against.
+func (c *fanoutCall) Submit(ctx context.Context) error {
+	err := c.Start(ctx)
+	return c.End(ctx, err)
+}
+
+func (c *fanoutCall) Start(ctx context.Context) error {
+	c.model.StartedAt = common.DateTime(time.Now())
+	c.model.Status = "running"
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(c.req.Body); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+
+	done := make(chan struct{})
+	var closeOnce sync.Once
+
+	for _, fn := range c.children {
+		fn := fn
+		go func() {
+			status, header, respBody, err := c.invokeChild(ctx, fn, body)
+			if c.aggregator.Aggregate(fn.ID, status, header, respBody, err) {
+				closeOnce.Do(func() { close(done) })
+			}
+		}()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *fanoutCall) End(ctx context.Context, errIn error) error {
+	c.model.CompletedAt = common.DateTime(time.Now())
+
+	switch errIn {
+	case nil:
+		c.model.Status = "success"
+	case context.DeadlineExceeded, context.Canceled:
+		c.model.Status = "timeout"
+		c.model.Error = errIn.Error()
+	default:
+		c.model.Status = "error"
+		c.model.Error = errIn.Error()
+	}
+
+	// Always give the aggregator a chance to write what it's collected so
+	// far, even when errIn is a context timeout/cancellation that cut
+	// Start short with stragglers still in flight - quorumAggregator in
+	// particular is built to report partial/quorum successes, and leaving
+	// the caller's ResponseWriter completely unwritten would throw that
+	// work away. Aggregate is safe to call concurrently with this (see
+	// collectingAggregator.snapshot).
+	if err := c.aggregator.Done(c.rw); err != nil {
+		common.Logger(ctx).WithError(err).Error("error writing fanout response")
+	}
+
+	return errIn
+}
+
+// invokeChild runs a single child fn's call to completion and returns its
+// response (or err if the call itself failed rather than producing one).
+func (c *fanoutCall) invokeChild(ctx context.Context, fn *models.Fn, body []byte) (int, http.Header, []byte, error) {
+	childReq := c.req.Clone(ctx)
+	childReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	childReq.ContentLength = int64(len(body))
+
+	rec := httptest.NewRecorder()
+
+	call, err := c.agent.GetCall(ctx,
+		FromHTTPTriggerRequest(c.app, fn, c.trigger, childReq),
+		WithWriter(rec),
+	)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if err := c.agent.Submit(ctx, call); err != nil {
+		return 0, nil, nil, err
+	}
+
+	return rec.Code, rec.Header(), rec.Body.Bytes(), nil
+}
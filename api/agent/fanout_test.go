@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+func TestFirstAggregatorReadyOnFirstResult(t *testing.T) {
+	agg, err := NewAggregator("first", 3)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+
+	if ready := agg.Aggregate("fn1", 200, nil, []byte(`{"a":1}`), nil); !ready {
+		t.Fatalf("expected ready on first result")
+	}
+
+	w := httptest.NewRecorder()
+	if err := agg.Done(w); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if w.Body.String() != `{"a":1}` {
+		t.Fatalf("got body %q", w.Body.String())
+	}
+}
+
+func TestAllAggregatorFailsOnAnyChildFailure(t *testing.T) {
+	agg, err := NewAggregator("all", 2)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+
+	if ready := agg.Aggregate("fn1", 200, nil, []byte(`{}`), nil); ready {
+		t.Fatalf("expected not ready after 1 of 2")
+	}
+	if ready := agg.Aggregate("fn2", 500, nil, nil, nil); !ready {
+		t.Fatalf("expected ready after 2 of 2")
+	}
+
+	w := httptest.NewRecorder()
+	if err := agg.Done(w); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestQuorumAggregatorReadyOnceQuorumMet(t *testing.T) {
+	agg, err := NewAggregator("quorum:2", 3)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+
+	if ready := agg.Aggregate("fn1", 200, nil, []byte(`{"a":1}`), nil); ready {
+		t.Fatalf("expected not ready after 1 success")
+	}
+	if ready := agg.Aggregate("fn2", 200, nil, []byte(`{"b":2}`), nil); !ready {
+		t.Fatalf("expected ready once quorum reached")
+	}
+
+	w := httptest.NewRecorder()
+	if err := agg.Done(w); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if w.Code != 0 && w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
+
+// TestQuorumAggregatorConcurrentStragglerIsSafe is a regression test for the
+// map race fixed in collectingAggregator.snapshot: Done must be safe to run
+// concurrently with stragglers still calling Aggregate after quorum has
+// already been met. Run with -race to catch a regression.
+func TestQuorumAggregatorConcurrentStragglerIsSafe(t *testing.T) {
+	agg, err := NewAggregator("quorum:1", 5)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+
+	if ready := agg.Aggregate("fn0", 200, nil, []byte(`{}`), nil); !ready {
+		t.Fatalf("expected ready after first success with quorum:1")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	w := httptest.NewRecorder()
+	go func() {
+		defer wg.Done()
+		agg.Done(w)
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 5; i++ {
+			agg.Aggregate(fmt.Sprintf("fn%d", i), 200, nil, []byte(`{}`), nil)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMergeJSONAggregatorMergesSuccessfulBodies(t *testing.T) {
+	agg, err := NewAggregator("merge-json", 2)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+
+	if ready := agg.Aggregate("fn1", 200, nil, []byte(`{"a":1}`), nil); ready {
+		t.Fatalf("expected not ready - merge always waits for every child")
+	}
+	if ready := agg.Aggregate("fn2", 200, nil, []byte(`{"b":2}`), nil); !ready {
+		t.Fatalf("expected ready once all children reported")
+	}
+
+	w := httptest.NewRecorder()
+	if err := agg.Done(w); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+
+	var merged map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &merged); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if merged["a"] == nil || merged["b"] == nil {
+		t.Fatalf("expected merged keys a and b, got %v", merged)
+	}
+}
+
+// TestFanoutCallEndWritesPartialResultsOnContextTimeout is a regression test:
+// if Start returns ctx.Err() because the fanout's context deadline was
+// exceeded with stragglers still in flight, End must still drive
+// aggregator.Done rather than leaving the ResponseWriter unwritten and
+// discarding whatever quorum/partial successes were already collected.
+func TestFanoutCallEndWritesPartialResultsOnContextTimeout(t *testing.T) {
+	agg, err := NewAggregator("quorum:2", 3)
+	if err != nil {
+		t.Fatalf("NewAggregator: %v", err)
+	}
+	// one success in before the timeout - not enough to meet quorum alone.
+	agg.Aggregate("fn1", 200, nil, []byte(`{"a":1}`), nil)
+
+	w := httptest.NewRecorder()
+	c := &fanoutCall{
+		model:      &models.Call{},
+		rw:         w,
+		aggregator: agg,
+	}
+
+	err = c.End(context.Background(), context.DeadlineExceeded)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("End returned %v, want context.DeadlineExceeded", err)
+	}
+	if c.model.Status != "timeout" {
+		t.Fatalf("got status %q, want timeout", c.model.Status)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got response status %d, want %d - aggregator.Done must still run", w.Code, http.StatusBadGateway)
+	}
+	if w.Body.Len() == 0 {
+		t.Fatalf("expected a written body describing the partial failure, got none")
+	}
+}
+
+func TestNewAggregatorRejectsInvalidQuorum(t *testing.T) {
+	if _, err := NewAggregator("quorum:0", 3); err == nil {
+		t.Fatalf("expected error for quorum:0")
+	}
+	if _, err := NewAggregator("quorum:4", 3); err == nil {
+		t.Fatalf("expected error for quorum exceeding n")
+	}
+	if _, err := NewAggregator("bogus", 3); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/fnproject/fn/api/common"
+	"github.com/fnproject/fn/api/id"
+	"github.com/fnproject/fn/api/models"
+)
+
+// jsonRPCMimeType is the Content-Type that marks a request as a JSON-RPC
+// 2.0 envelope, in addition to sniffing the body itself (see
+// isJSONRPCRequest).
+const jsonRPCMimeType = "application/json-rpc"
+
+// JSON-RPC 2.0 reserved error codes:
+// https://www.jsonrpc.org/specification#error_object
+const (
+	jsonRPCErrParse          = -32700
+	jsonRPCErrInvalidRequest = -32600
+	jsonRPCErrMethodNotFound = -32601
+	jsonRPCErrInvalidParams  = -32602
+	jsonRPCErrInternal       = -32603
+)
+
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// isNotification reports whether r is a notification (no id), which per
+// spec must not produce a response element.
+func (r jsonRPCRequest) isNotification() bool {
+	return len(r.ID) == 0
+}
+
+type jsonRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, message string, data interface{}) *jsonRPCResponse {
+	return &jsonRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   &jsonRPCError{Code: code, Message: message, Data: data},
+	}
+}
+
+// isJSONRPCRequest reports whether req looks like a JSON-RPC call, either
+// by Content-Type or by sniffing the body for a "jsonrpc" envelope field.
+func isJSONRPCRequest(header http.Header, body []byte) bool {
+	if t, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && t == jsonRPCMimeType {
+		return true
+	}
+	return bytes.Contains(body, []byte(`"jsonrpc"`))
+}
+
+// parseJSONRPCBody parses body as either a single JSON-RPC request object
+// or a batch (JSON array of request objects), per spec section 6.
+func parseJSONRPCBody(body []byte) (reqs []jsonRPCRequest, isBatch bool, err error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, false, errors.New("empty body")
+	}
+
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &reqs); err != nil {
+			return nil, true, err
+		}
+		return reqs, true, nil
+	}
+
+	var r jsonRPCRequest
+	if err := json.Unmarshal(trimmed, &r); err != nil {
+		return nil, false, err
+	}
+	return []jsonRPCRequest{r}, false, nil
+}
+
+// buildJSONRPCConfig assembles the container env for a single JSON-RPC
+// method dispatch: the usual trigger config, plus FN_FORMAT=json-rpc and
+// FN_METHOD so the FDK knows which method within the batch it's handling.
+func buildJSONRPCConfig(ctx context.Context, app *models.App, fn *models.Fn, trigger *models.Trigger, method string, header http.Header) models.Config {
+	conf := buildTriggerConfig(ctx, app, fn, trigger, header)
+	conf["FN_FORMAT"] = models.FormatJSONRPC
+	conf["FN_METHOD"] = method
+	return conf
+}
+
+// FromJSONRPCMethodRequest builds the CallOpt for a single JSON-RPC method
+// dispatch within a batch: much like FromHTTPTriggerRequest, but forces
+// the json-rpc wire format and records which method is being invoked.
+func FromJSONRPCMethodRequest(app *models.App, fn *models.Fn, trigger *models.Trigger, method string, req *http.Request) CallOpt {
+	return func(ctx context.Context, c *call) error {
+		fn.Format = models.FormatJSONRPC
+
+		callID := id.New().String()
+		if rw, ok := c.w.(http.ResponseWriter); ok {
+			rw.Header().Add("FN_CALL_ID", callID)
+		}
+
+		var syslogURL string
+		if app.SyslogURL != nil {
+			syslogURL = *app.SyslogURL
+		}
+
+		c.Call = &models.Call{
+			ID:          callID,
+			Path:        trigger.Source,
+			Image:       fn.Image,
+			Type:        "sync",
+			Format:      fn.Format,
+			Priority:    new(int32),
+			Timeout:     fn.Timeout,
+			IdleTimeout: fn.IdleTimeout,
+			Memory:      fn.Memory,
+			Config:      buildJSONRPCConfig(ctx, app, fn, trigger, method, req.Header),
+			Annotations: app.Annotations.MergeChange(fn.Annotations).MergeChange(trigger.Annotations),
+			Headers:     req.Header,
+			CreatedAt:   common.DateTime(time.Now()),
+			URL:         reqURL(req),
+			Method:      req.Method,
+			AppID:       app.ID,
+			FnID:        fn.ID,
+			TriggerID:   trigger.ID,
+			SyslogURL:   syslogURL,
+		}
+
+		return setCallPayload(ctx, req.Body, c)
+	}
+}
+
+// jsonRPCCall is the Call returned by FromJSONRPCRequest: its Start
+// dispatches each method in the (possibly batched) request to its mapped
+// fn, each as its own hot-container invocation, and its End reassembles
+// the ordered JSON-RPC response (or batch response) to the caller.
+type jsonRPCCall struct {
+	agent   *agent
+	app     *models.App
+	trigger *models.Trigger
+	methods map[string]*models.Fn
+	req     *http.Request
+	rw      http.ResponseWriter
+
+	model *models.Call
+
+	isBatch bool
+	// emptyBatch marks the JSON-RPC 2.0 section 6 special case of an empty
+	// batch array ("[]"), whose single response is an Invalid Request error
+	// object, not itself wrapped in an array.
+	emptyBatch bool
+	responses  []*jsonRPCResponse // nil entry = notification, no response element
+}
+
+// FromJSONRPCRequest builds a Call that parses req's body as a JSON-RPC
+// 2.0 request or batch, dispatches each method call to the fn mapped to it
+// by methods, and reassembles ordered responses (skipping notifications)
+// into a JSON-RPC response or batch response. Drive the returned Call via
+// its own Submit method, not agent.Submit: its concrete type isn't *call,
+// and agent.Submit isn't guaranteed to accept anything else.
+func (a *agent) FromJSONRPCRequest(app *models.App, methods map[string]*models.Fn, trigger *models.Trigger, req *http.Request, rw http.ResponseWriter) (Call, error) {
+	if len(methods) == 0 {
+		return nil, errors.New("json-rpc requires at least one method mapping")
+	}
+
+	return &jsonRPCCall{
+		agent:   a,
+		app:     app,
+		trigger: trigger,
+		methods: methods,
+		req:     req,
+		rw:      rw,
+		model: &models.Call{
+			ID:        id.New().String(),
+			Path:      trigger.Source,
+			Type:      "sync",
+			Format:    models.FormatJSONRPC,
+			Priority:  new(int32),
+			CreatedAt: common.DateTime(time.Now()),
+			URL:       reqURL(req),
+			Method:    req.Method,
+			AppID:     app.ID,
+			TriggerID: trigger.ID,
+		},
+	}, nil
+}
+
+func (c *jsonRPCCall) Model() *models.Call { return c.model }
+
+// Submit drives the batch to completion: Start, then End with whatever
+// error Start returned. Callers should use this rather than agent.Submit,
+// since a jsonRPCCall isn't the *call concrete type agent.Submit is written
+// against.
+func (c *jsonRPCCall) Submit(ctx context.Context) error {
+	err := c.Start(ctx)
+	return c.End(ctx, err)
+}
+
+func (c *jsonRPCCall) Start(ctx context.Context) error {
+	c.model.StartedAt = common.DateTime(time.Now())
+	c.model.Status = "running"
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(c.req.Body); err != nil {
+		return err
+	}
+
+	reqs, isBatch, err := parseJSONRPCBody(buf.Bytes())
+	if err != nil {
+		c.isBatch = false
+		c.responses = []*jsonRPCResponse{newJSONRPCErrorResponse(nil, jsonRPCErrParse, "parse error", err.Error())}
+		return nil
+	}
+	c.isBatch = isBatch
+
+	if isBatch && len(reqs) == 0 {
+		// Per spec section 6, an empty batch array is itself an invalid
+		// request - respond with a single Invalid Request error object,
+		// not an empty/204 response.
+		c.emptyBatch = true
+		c.responses = []*jsonRPCResponse{newJSONRPCErrorResponse(nil, jsonRPCErrInvalidRequest, "invalid request", "empty batch")}
+		return nil
+	}
+
+	c.responses = make([]*jsonRPCResponse, len(reqs))
+
+	var wg sync.WaitGroup
+	for i, r := range reqs {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.responses[i] = c.dispatch(ctx, r)
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// dispatch runs a single request from the batch to completion and returns
+// its JSON-RPC response, or nil if r is a notification.
+func (c *jsonRPCCall) dispatch(ctx context.Context, r jsonRPCRequest) *jsonRPCResponse {
+	if r.JSONRPC != "2.0" || r.Method == "" {
+		if r.isNotification() {
+			return nil
+		}
+		return newJSONRPCErrorResponse(r.ID, jsonRPCErrInvalidRequest, "invalid request", nil)
+	}
+
+	if len(r.Params) > 0 && !json.Valid(r.Params) {
+		if r.isNotification() {
+			return nil
+		}
+		return newJSONRPCErrorResponse(r.ID, jsonRPCErrInvalidParams, "invalid params", nil)
+	}
+
+	fn, ok := c.methods[r.Method]
+	if !ok {
+		if r.isNotification() {
+			return nil
+		}
+		return newJSONRPCErrorResponse(r.ID, jsonRPCErrMethodNotFound, fmt.Sprintf("method not found: %s", r.Method), nil)
+	}
+
+	childReq := c.req.Clone(ctx)
+	childReq.Body = ioutil.NopCloser(bytes.NewReader(r.Params))
+	childReq.ContentLength = int64(len(r.Params))
+
+	rec := httptest.NewRecorder()
+
+	call, err := c.agent.GetCall(ctx,
+		FromJSONRPCMethodRequest(c.app, fn, c.trigger, r.Method, childReq),
+		WithWriter(rec),
+	)
+	if err == nil {
+		err = c.agent.Submit(ctx, call)
+	}
+
+	if r.isNotification() {
+		return nil
+	}
+
+	if err != nil {
+		return newJSONRPCErrorResponse(r.ID, jsonRPCErrInternal, "internal error", err.Error())
+	}
+	if rec.Code >= 400 {
+		return newJSONRPCErrorResponse(r.ID, jsonRPCErrInternal, "internal error", rec.Body.String())
+	}
+
+	return &jsonRPCResponse{JSONRPC: "2.0", ID: r.ID, Result: json.RawMessage(rec.Body.Bytes())}
+}
+
+func (c *jsonRPCCall) End(ctx context.Context, errIn error) error {
+	c.model.CompletedAt = common.DateTime(time.Now())
+	if errIn != nil {
+		c.model.Status = "error"
+		c.model.Error = errIn.Error()
+		return errIn
+	}
+	c.model.Status = "success"
+
+	var out []*jsonRPCResponse
+	for _, r := range c.responses {
+		if r != nil {
+			out = append(out, r)
+		}
+	}
+
+	c.rw.Header().Set("Content-Type", jsonRPCMimeType)
+
+	if len(out) == 0 {
+		// all-notifications batch (or single notification): nothing to send.
+		c.rw.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if !c.isBatch || c.emptyBatch {
+		return json.NewEncoder(c.rw).Encode(out[0])
+	}
+	return json.NewEncoder(c.rw).Encode(out)
+}
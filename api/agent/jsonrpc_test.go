@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+func TestParseJSONRPCBodySingle(t *testing.T) {
+	reqs, isBatch, err := parseJSONRPCBody([]byte(`{"jsonrpc":"2.0","id":1,"method":"foo"}`))
+	if err != nil {
+		t.Fatalf("parseJSONRPCBody: %v", err)
+	}
+	if isBatch {
+		t.Fatalf("expected non-batch")
+	}
+	if len(reqs) != 1 || reqs[0].Method != "foo" {
+		t.Fatalf("got %+v", reqs)
+	}
+}
+
+func TestParseJSONRPCBodyBatch(t *testing.T) {
+	reqs, isBatch, err := parseJSONRPCBody([]byte(`[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","method":"b"}]`))
+	if err != nil {
+		t.Fatalf("parseJSONRPCBody: %v", err)
+	}
+	if !isBatch {
+		t.Fatalf("expected batch")
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("got %d reqs, want 2", len(reqs))
+	}
+	if !reqs[1].isNotification() {
+		t.Fatalf("expected reqs[1] to be a notification")
+	}
+}
+
+func TestParseJSONRPCBodyEmptyBatch(t *testing.T) {
+	reqs, isBatch, err := parseJSONRPCBody([]byte(`[]`))
+	if err != nil {
+		t.Fatalf("parseJSONRPCBody: %v", err)
+	}
+	if !isBatch {
+		t.Fatalf("expected batch")
+	}
+	if len(reqs) != 0 {
+		t.Fatalf("got %d reqs, want 0", len(reqs))
+	}
+}
+
+func TestDispatchInvalidRequest(t *testing.T) {
+	c := &jsonRPCCall{}
+	resp := c.dispatch(context.Background(), jsonRPCRequest{ID: json.RawMessage("1")})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonRPCErrInvalidRequest {
+		t.Fatalf("got %+v, want invalid request error", resp)
+	}
+}
+
+func TestDispatchNotificationOfInvalidRequestReturnsNil(t *testing.T) {
+	c := &jsonRPCCall{}
+	if resp := c.dispatch(context.Background(), jsonRPCRequest{}); resp != nil {
+		t.Fatalf("expected nil response for a notification, got %+v", resp)
+	}
+}
+
+func TestDispatchMethodNotFound(t *testing.T) {
+	c := &jsonRPCCall{methods: map[string]*models.Fn{}}
+	resp := c.dispatch(context.Background(), jsonRPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: "missing"})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonRPCErrMethodNotFound {
+		t.Fatalf("got %+v, want method not found error", resp)
+	}
+}
+
+func TestDispatchInvalidParams(t *testing.T) {
+	c := &jsonRPCCall{methods: map[string]*models.Fn{"foo": {}}}
+	resp := c.dispatch(context.Background(), jsonRPCRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  "foo",
+		Params:  json.RawMessage(`not-json`),
+	})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonRPCErrInvalidParams {
+		t.Fatalf("got %+v, want invalid params error", resp)
+	}
+}
+
+func TestEndEmptyBatchReturnsSingleInvalidRequestError(t *testing.T) {
+	c := &jsonRPCCall{
+		model:      &models.Call{},
+		rw:         httptest.NewRecorder(),
+		isBatch:    true,
+		emptyBatch: true,
+		responses:  []*jsonRPCResponse{newJSONRPCErrorResponse(nil, jsonRPCErrInvalidRequest, "invalid request", "empty batch")},
+	}
+
+	if err := c.End(context.Background(), nil); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+
+	w := c.rw.(*httptest.ResponseRecorder)
+	var resp jsonRPCResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response body isn't a single object: %v (%s)", err, w.Body.String())
+	}
+	if resp.Error == nil || resp.Error.Code != jsonRPCErrInvalidRequest {
+		t.Fatalf("got %+v, want invalid request error", resp)
+	}
+}
+
+func TestEndAllNotificationsReturnsNoContent(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := &jsonRPCCall{
+		model:     &models.Call{},
+		rw:        w,
+		isBatch:   true,
+		responses: []*jsonRPCResponse{nil, nil},
+	}
+
+	if err := c.End(context.Background(), nil); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+	if w.Code != 204 {
+		t.Fatalf("got status %d, want 204", w.Code)
+	}
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+// defaultMaxInFlight bounds the number of body chunks a streaming call will
+// read ahead of the consumer before the producer blocks, giving a slow
+// container backpressure against a fast client (and vice versa).
+const defaultMaxInFlight = 4
+
+// streamChunkSize is the read buffer size used to pull chunks off the
+// underlying body for a streaming call.
+const streamChunkSize = 32 * 1024
+
+// WithStreamingBody opts a call into streaming mode: body is handed to the
+// container via Call's StreamingPayload method instead of being buffered
+// into Payload up front by setCallPayload. maxInFlight bounds how many
+// chunks may be read ahead of the consumer; 0 uses defaultMaxInFlight.
+func WithStreamingBody(body io.ReadCloser, maxInFlight int) CallOpt {
+	return func(_ context.Context, c *call) error {
+		if maxInFlight <= 0 {
+			maxInFlight = defaultMaxInFlight
+		}
+		c.streamingBody = body
+		c.maxInFlight = maxInFlight
+		return nil
+	}
+}
+
+// WithFramedIO opts an already-streaming call into the length-prefixed
+// frame protocol (see writeFrame/readFrame) on its input, and marks the
+// call (see IsFramedIO). Only the input is framed automatically: nothing in
+// the agent un-frames the container's stdout, which a caller has to do
+// itself with ReadFramedOutput. This is opt-in rather
+// than automatic: switching a format's wire shape from a flat byte stream
+// to framed chunks would otherwise silently corrupt I/O for any existing
+// container built against the older, unframed contract. Has no effect if
+// the call's format doesn't support framing (see formatIsFramable); must
+// be applied after WithStreamingBody/FromStreamingRequest.
+func WithFramedIO() CallOpt {
+	return func(_ context.Context, c *call) error {
+		if c.Call != nil && formatIsFramable(c.Format) {
+			c.framedIO = true
+		}
+		return nil
+	}
+}
+
+// StreamingPayload returns the request body for a call opted into streaming
+// via WithStreamingBody/FromStreamingRequest, wrapped so that reads apply
+// backpressure once maxInFlight chunks are buffered ahead of the consumer.
+// Returns nil if the call wasn't opted into streaming. The reader is built
+// once and cached, matching the buffered Payload path, since RequestBody
+// may be called more than once (e.g. retries) and spawning a second
+// producer goroutine over the same body would race.
+//
+// When the call was opted into WithFramedIO, each chunk read off the
+// backpressured body is written through as its own length-prefixed frame,
+// so the container can tell partial-input boundaries apart on a single
+// stdio stream instead of seeing one undifferentiated byte stream. The
+// container's stdout is not un-framed here; ReadFramedOutput does that for
+// a caller that checks IsFramedIO.
+func (c *call) StreamingPayload() io.ReadCloser {
+	if c.streamingBody == nil {
+		return nil
+	}
+	if c.streamingReader == nil {
+		body := newBackpressureReader(c.streamingBody, c.maxInFlight)
+		if c.framedIO {
+			body = newFramingReader(body)
+		}
+		c.streamingReader = body
+	}
+	return c.streamingReader
+}
+
+// IsFramedIO reports whether this call was opted into the length-prefixed
+// frame protocol via WithFramedIO, i.e. whether the container's stdout has
+// to be read back through ReadFramedOutput instead of as a flat stream.
+func (c *call) IsFramedIO() bool { return c.framedIO }
+
+// framingReader re-chunks a backpressureReader's output into length-prefixed
+// frames (see writeFrame), one per underlying chunk, so a framable format's
+// container can read discrete input frames off a single stdio stream
+// instead of a flat byte stream with no message boundaries.
+type framingReader struct {
+	src     io.ReadCloser
+	buf     []byte
+	pending bytes.Buffer
+}
+
+func newFramingReader(src io.ReadCloser) io.ReadCloser {
+	return &framingReader{src: src, buf: make([]byte, streamChunkSize)}
+}
+
+func (r *framingReader) Read(p []byte) (int, error) {
+	if r.pending.Len() == 0 {
+		n, err := r.src.Read(r.buf)
+		if n > 0 {
+			if werr := writeFrame(&r.pending, r.buf[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err != nil {
+			if r.pending.Len() == 0 {
+				return 0, err
+			}
+			// surface the framed chunk now; the caller will see err on the
+			// next Read once pending drains.
+		}
+	}
+	return r.pending.Read(p)
+}
+
+func (r *framingReader) Close() error {
+	return r.src.Close()
+}
+
+// ReadFramedOutput reads every length-prefixed frame written by writeFrame
+// from r until EOF, concatenating them into a single response body. Meant
+// for the driver side reading a framable-format container's stdout back,
+// mirroring the framing StreamingPayload applies on the way in.
+func ReadFramedOutput(r io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				return out.Bytes(), nil
+			}
+			return nil, err
+		}
+		out.Write(frame)
+	}
+}
+
+// backpressureReader pulls chunks from the underlying body in a background
+// goroutine and hands them to the consumer over a bounded channel, so a
+// slow consumer blocks the producer rather than either side growing an
+// unbounded buffer. Close unblocks the producer even if it's parked on a
+// full channel send, so the goroutine can't outlive an abandoned reader.
+type backpressureReader struct {
+	chunks <-chan []byte
+	errc   <-chan error
+	done   chan struct{}
+	cur    []byte
+	body   io.Closer
+}
+
+func newBackpressureReader(body io.ReadCloser, maxInFlight int) io.ReadCloser {
+	chunks := make(chan []byte, maxInFlight)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, streamChunkSize)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				select {
+				case chunks <- chunk:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					select {
+					case errc <- err:
+					case <-done:
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	return &backpressureReader{chunks: chunks, errc: errc, done: done, body: body}
+}
+
+func (r *backpressureReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		chunk, ok := <-r.chunks
+		if !ok {
+			select {
+			case err := <-r.errc:
+				return 0, err
+			default:
+				return 0, io.EOF
+			}
+		}
+		r.cur = chunk
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close unblocks the producer goroutine (even mid blocking-send) and closes
+// the underlying body. Safe to call more than once.
+func (r *backpressureReader) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	return r.body.Close()
+}
+
+// formatIsFramable reports whether format supports the length-prefixed
+// framing protocol below, letting a single container stdio stream carry
+// multiple partial input/output frames instead of one shot in, one shot
+// out. Today that's cloudevent and http - both have a well defined
+// message boundary to frame around.
+func formatIsFramable(format string) bool {
+	return format == models.FormatCloudEvent || format == models.FormatHTTP
+}
+
+// writeFrame writes b to w as a single length-prefixed frame: a 4 byte
+// big-endian length followed by the payload. Used to multiplex partial
+// input/output over a container's stdio for streaming-capable formats.
+func writeFrame(w io.Writer, b []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads a single length-prefixed frame written by writeFrame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+func TestBackpressureReaderReadsAllData(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), streamChunkSize*3+17)
+	body := ioutil.NopCloser(bytes.NewReader(data))
+
+	r := newBackpressureReader(body, 1)
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestBackpressureReaderCloseUnblocksProducer(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	// maxInFlight of 1 means that once the consumer stops reading after the
+	// first chunk, the second sits in the channel and the producer blocks
+	// trying to send its third.
+	r := newBackpressureReader(pr, 1)
+
+	go func() {
+		buf := make([]byte, streamChunkSize)
+		for i := 0; i < 4; i++ {
+			pw.Write(buf)
+		}
+	}()
+
+	buf := make([]byte, streamChunkSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.Close()
+		// the producer closes chunks on its way out, so draining it to the
+		// end shows the goroutine has exited.
+		for range r.(*backpressureReader).chunks {
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close did not return - producer goroutine leaked")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := []byte("hello frame")
+	if err := writeFrame(&buf, want); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestFramingReaderFramesEachChunk(t *testing.T) {
+	data := []byte("first-chunk")
+	body := ioutil.NopCloser(bytes.NewReader(data))
+
+	r := newFramingReader(body)
+	defer r.Close()
+
+	framed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	got, err := readFrame(bytes.NewReader(framed))
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q want %q", got, data)
+	}
+}
+
+// TestStreamingPayloadFramingIsOptIn verifies framing isn't applied unless
+// WithFramedIO was used, even for a framable format - switching a format's
+// wire shape on by default would silently corrupt I/O for any container
+// built against the older, unframed contract.
+func TestStreamingPayloadFramingIsOptIn(t *testing.T) {
+	data := []byte("plain-body")
+
+	c := &call{Call: &models.Call{Format: models.FormatCloudEvent}}
+	if err := WithStreamingBody(ioutil.NopCloser(bytes.NewReader(data)), 1)(context.Background(), c); err != nil {
+		t.Fatalf("WithStreamingBody: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(c.StreamingPayload())
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q, want the raw unframed body %q", got, data)
+	}
+	if c.IsFramedIO() {
+		t.Fatalf("expected IsFramedIO to be false without WithFramedIO")
+	}
+}
+
+// TestStreamingPayloadFramedRoundTrip exercises input->container->output
+// through the full frame protocol: StreamingPayload frames the input the
+// same way a container is expected to frame its output, and
+// ReadFramedOutput un-frames it back to the original chunks.
+func TestStreamingPayloadFramedRoundTrip(t *testing.T) {
+	chunks := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	pr, pw := io.Pipe()
+	go func() {
+		for _, chunk := range chunks {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+
+	c := &call{Call: &models.Call{Format: models.FormatCloudEvent}}
+	if err := WithStreamingBody(pr, 1)(context.Background(), c); err != nil {
+		t.Fatalf("WithStreamingBody: %v", err)
+	}
+	if err := WithFramedIO()(context.Background(), c); err != nil {
+		t.Fatalf("WithFramedIO: %v", err)
+	}
+	if !c.IsFramedIO() {
+		t.Fatalf("expected IsFramedIO to be true after WithFramedIO")
+	}
+
+	var framed bytes.Buffer
+	if _, err := io.Copy(&framed, c.StreamingPayload()); err != nil {
+		t.Fatalf("io.Copy: %v", err)
+	}
+
+	out, err := ReadFramedOutput(&framed)
+	if err != nil {
+		t.Fatalf("ReadFramedOutput: %v", err)
+	}
+	if string(out) != "firstsecondthird" {
+		t.Fatalf("got %q, want %q", out, "firstsecondthird")
+	}
+}
+
+func TestReadFramedOutputConcatenatesFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("abc")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if err := writeFrame(&buf, []byte("def")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	out, err := ReadFramedOutput(&buf)
+	if err != nil {
+		t.Fatalf("ReadFramedOutput: %v", err)
+	}
+	if string(out) != "abcdef" {
+		t.Fatalf("got %q want %q", out, "abcdef")
+	}
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/trace"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+// traceContextAnnotationKey stores the trace context found on the inbound
+// request as an annotation on the call, so it survives the store-and-forward
+// hop for async calls where there's no live request/response to carry
+// correlation headers on.
+const traceContextAnnotationKey = "fn.io/trace_context"
+
+// traceContextAnnotation is the JSON shape stored under
+// traceContextAnnotationKey.
+type traceContextAnnotation struct {
+	TraceID      string `json:"trace_id"`
+	SpanID       string `json:"span_id"`
+	TraceOptions uint8  `json:"trace_options"`
+}
+
+// injectTraceContext extracts distributed-trace correlation headers
+// (W3C traceparent/tracestate, Google's X-Cloud-Trace-Context, Zipkin's
+// X-B3-*) from header, joins/overrides ctx's current opencensus span
+// context with whatever it finds, and writes the result into conf as
+// FN_TRACE_ID/FN_SPAN_ID/FN_TRACE_FLAGS so the container can continue the
+// trace. It returns the resulting span context so the caller can re-emit a
+// fresh traceparent header for the call's own Headers.
+func injectTraceContext(ctx context.Context, header http.Header, conf models.Config) trace.SpanContext {
+	var sc trace.SpanContext
+	if span := trace.FromContext(ctx); span != nil {
+		sc = span.SpanContext()
+	}
+
+	if remote, ok := parseTraceContext(header); ok {
+		sc = remote
+	}
+
+	if sc.TraceID == (trace.TraceID{}) {
+		return sc
+	}
+
+	conf["FN_TRACE_ID"] = sc.TraceID.String()
+	conf["FN_SPAN_ID"] = sc.SpanID.String()
+	conf["FN_TRACE_FLAGS"] = fmt.Sprintf("%02x", uint8(sc.TraceOptions))
+	return sc
+}
+
+// traceParentHeader re-emits sc as a W3C traceparent header value, for
+// handing off to downstream services from within the user function.
+func traceParentHeader(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID.String(), sc.SpanID.String(), uint8(sc.TraceOptions))
+}
+
+// parseTraceContext tries each supported distributed tracing header format
+// in turn and returns the first one that parses successfully.
+func parseTraceContext(header http.Header) (trace.SpanContext, bool) {
+	if tp := header.Get("traceparent"); tp != "" {
+		if sc, ok := parseW3CTraceParent(tp); ok {
+			return sc, true
+		}
+	}
+	if gc := header.Get("X-Cloud-Trace-Context"); gc != "" {
+		if sc, ok := parseCloudTraceContext(gc); ok {
+			return sc, true
+		}
+	}
+	if sc, ok := parseB3Headers(header); ok {
+		return sc, true
+	}
+	return trace.SpanContext{}, false
+}
+
+// parseW3CTraceParent parses a "traceparent" header of the form
+// "{version}-{trace-id}-{parent-id}-{trace-flags}", e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseW3CTraceParent(tp string) (trace.SpanContext, bool) {
+	parts := strings.Split(tp, "-")
+	if len(parts) != 4 {
+		return trace.SpanContext{}, false
+	}
+
+	traceIDBytes, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceIDBytes) != 16 {
+		return trace.SpanContext{}, false
+	}
+	spanIDBytes, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanIDBytes) != 8 {
+		return trace.SpanContext{}, false
+	}
+	flagsBytes, err := hex.DecodeString(parts[3])
+	if err != nil || len(flagsBytes) != 1 {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	copy(sc.TraceID[:], traceIDBytes)
+	copy(sc.SpanID[:], spanIDBytes)
+	sc.TraceOptions = trace.TraceOptions(flagsBytes[0])
+	return sc, true
+}
+
+// parseCloudTraceContext parses Google's "X-Cloud-Trace-Context" header of
+// the form "TRACE_ID/SPAN_ID;o=TRACE_TRUE".
+func parseCloudTraceContext(h string) (trace.SpanContext, bool) {
+	slash := strings.IndexByte(h, '/')
+	if slash < 0 {
+		return trace.SpanContext{}, false
+	}
+
+	traceIDHex := h[:slash]
+	rest := h[slash+1:]
+
+	spanIDStr := rest
+	sampled := false
+	if semi := strings.IndexByte(rest, ';'); semi >= 0 {
+		spanIDStr = rest[:semi]
+		sampled = strings.Contains(rest[semi:], "o=1")
+	}
+
+	traceIDBytes, err := hex.DecodeString(traceIDHex)
+	if err != nil || len(traceIDBytes) != 16 {
+		return trace.SpanContext{}, false
+	}
+	spanID, err := strconv.ParseUint(spanIDStr, 10, 64)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	copy(sc.TraceID[:], traceIDBytes)
+	binary.BigEndian.PutUint64(sc.SpanID[:], spanID)
+	if sampled {
+		sc.TraceOptions = trace.TraceOptions(1)
+	}
+	return sc, true
+}
+
+// parseB3Headers parses Zipkin's multi-header form: X-B3-TraceId,
+// X-B3-SpanId and X-B3-Sampled.
+func parseB3Headers(header http.Header) (trace.SpanContext, bool) {
+	traceIDHex := header.Get("X-B3-TraceId")
+	spanIDHex := header.Get("X-B3-SpanId")
+	if traceIDHex == "" || spanIDHex == "" {
+		return trace.SpanContext{}, false
+	}
+
+	// B3 trace ids may be 64 or 128 bit; left-pad 64 bit ids out to 128 bit.
+	if len(traceIDHex) == 16 {
+		traceIDHex = strings.Repeat("0", 16) + traceIDHex
+	}
+
+	traceIDBytes, err := hex.DecodeString(traceIDHex)
+	if err != nil || len(traceIDBytes) != 16 {
+		return trace.SpanContext{}, false
+	}
+	spanIDBytes, err := hex.DecodeString(spanIDHex)
+	if err != nil || len(spanIDBytes) != 8 {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	copy(sc.TraceID[:], traceIDBytes)
+	copy(sc.SpanID[:], spanIDBytes)
+	if header.Get("X-B3-Sampled") == "1" {
+		sc.TraceOptions = trace.TraceOptions(1)
+	}
+	return sc, true
+}
+
+// WithTraceContext stashes the trace context carried by ctx's current
+// opencensus span as an annotation on the call being built, so that callers
+// constructing calls from non-HTTP paths (async MQ, pure runner) can still
+// have the ingress trace survive the store-and-forward hop through to
+// FN_TRACE_ID/FN_SPAN_ID on the eventual run. Must be applied after the
+// call's model has been set (e.g. after FromModel).
+func WithTraceContext(ctx context.Context) CallOpt {
+	return func(_ context.Context, c *call) error {
+		if c.Call == nil {
+			return errors.New("call must be set before WithTraceContext can be applied")
+		}
+
+		span := trace.FromContext(ctx)
+		if span == nil {
+			return nil
+		}
+		sc := span.SpanContext()
+		if sc.TraceID == (trace.TraceID{}) {
+			return nil
+		}
+
+		tc, err := json.Marshal(traceContextAnnotation{
+			TraceID:      sc.TraceID.String(),
+			SpanID:       sc.SpanID.String(),
+			TraceOptions: uint8(sc.TraceOptions),
+		})
+		if err != nil {
+			return err
+		}
+
+		c.Call.Annotations = c.Call.Annotations.MergeChange(models.Annotations{
+			traceContextAnnotationKey: tc,
+		})
+		return nil
+	}
+}
+
+// applyStoredTraceContext reads back the trace context annotation stashed by
+// WithTraceContext and writes FN_TRACE_ID/FN_SPAN_ID/FN_TRACE_FLAGS into the
+// call's Config. Used by FromModel/FromModelAndInput when picking an async
+// call back up from the datastore/MQ, where there's no live request to
+// parse correlation headers from - the annotation is the only place the
+// original ingress trace survives.
+func applyStoredTraceContext(call *models.Call) {
+	raw, ok := call.Annotations[traceContextAnnotationKey]
+	if !ok {
+		return
+	}
+
+	var tc traceContextAnnotation
+	if err := json.Unmarshal(raw, &tc); err != nil {
+		return
+	}
+
+	if call.Config == nil {
+		call.Config = make(models.Config)
+	}
+	call.Config["FN_TRACE_ID"] = tc.TraceID
+	call.Config["FN_SPAN_ID"] = tc.SpanID
+	call.Config["FN_TRACE_FLAGS"] = fmt.Sprintf("%02x", tc.TraceOptions)
+}
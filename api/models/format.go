@@ -0,0 +1,6 @@
+package models
+
+// FormatJSONRPC identifies a fn invoked via the JSON-RPC 2.0 request/batch
+// protocol (see api/agent/jsonrpc.go), added to the existing set of Route/Fn
+// Format constants (FormatDefault, FormatHTTP, FormatCloudEvent).
+const FormatJSONRPC = "json-rpc"